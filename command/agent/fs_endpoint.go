@@ -3,20 +3,17 @@ package agent
 //go:generate codecgen -d 101 -o fs_endpoint.generated.go fs_endpoint.go
 
 import (
-	"bytes"
-	"context"
+	"compress/gzip"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/docker/docker/pkg/ioutils"
 	cstructs "github.com/hashicorp/nomad/client/structs"
-	"github.com/hashicorp/nomad/nomad/structs"
-	"github.com/ugorji/go/codec"
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
@@ -29,27 +26,15 @@ var (
 )
 
 const (
-	// streamFrameSize is the maximum number of bytes to send in a single frame
+	// streamFrameSize is the default chunk_size used when streaming readat/cat.
 	streamFrameSize = 64 * 1024
 
-	// streamHeartbeatRate is the rate at which a heartbeat will occur to detect
-	// a closed connection without sending any additional data
-	streamHeartbeatRate = 1 * time.Second
-
-	// streamBatchWindow is the window in which file content is batched before
-	// being flushed if the frame size has not been hit.
-	streamBatchWindow = 200 * time.Millisecond
-
-	// nextLogCheckRate is the rate at which we check for a log entry greater
-	// than what we are watching for. This is to handle the case in which logs
-	// rotate faster than we can detect and we have to rely on a normal
-	// directory listing.
-	nextLogCheckRate = 100 * time.Millisecond
-
-	// deleteEvent and truncateEvent are the file events that can be sent in a
-	// StreamFrame
-	deleteEvent   = "file deleted"
-	truncateEvent = "file truncated"
+	// minChunkSize and maxChunkSize bound the chunk_size query parameter
+	// accepted by readat/cat so a client can't force either pathologically
+	// small (syscall-heavy) or pathologically large (unbounded buffering)
+	// reads.
+	minChunkSize = 1 * 1024
+	maxChunkSize = 1024 * 1024
 
 	// OriginStart and OriginEnd are the available parameters for the origin
 	// argument when streaming a file. They respectively offset from the start
@@ -96,11 +81,11 @@ func (s *HTTPServer) FsRequest(resp http.ResponseWriter, req *http.Request) (int
 		//return nil, structs.ErrPermissionDenied
 		//}
 		return s.FileCatRequest(resp, req)
-	//case strings.HasPrefix(path, "stream/"):
-	//if aclObj != nil && !aclObj.AllowNsOp(namespace, acl.NamespaceCapabilityReadFS) {
-	//return nil, structs.ErrPermissionDenied
-	//}
-	//return s.Stream(resp, req)
+	case strings.HasPrefix(path, "stream/"):
+		//if aclObj != nil && !aclObj.AllowNsOp(namespace, acl.NamespaceCapabilityReadFS) {
+		//return nil, structs.ErrPermissionDenied
+		//}
+		return s.Stream(resp, req)
 	case strings.HasPrefix(path, "logs/"):
 		// Logs can be accessed with ReadFS or ReadLogs caps
 		//if aclObj != nil {
@@ -172,27 +157,187 @@ func (s *HTTPServer) FileReadAtRequest(resp http.ResponseWriter, req *http.Reque
 		}
 	}
 
+	chunkSize, err := parseChunkSize(q)
+	if err != nil {
+		return nil, err
+	}
+
 	fs, err := s.agent.client.GetAllocFS(allocID)
 	if err != nil {
 		return nil, err
 	}
 
+	fileInfo, err := fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	etag := fmt.Sprintf("%q", fmt.Sprintf("%d-%d", fileInfo.Size, fileInfo.ModTime.UnixNano()))
+	resp.Header().Set("Accept-Ranges", "bytes")
+	resp.Header().Set("ETag", etag)
+
+	status := http.StatusOK
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+		// If-Range invalidates the range request (falling back to serving
+		// the whole, current file) when the file has rotated out from under
+		// a resuming client.
+		if ifRange := req.Header.Get("If-Range"); ifRange == "" || ifRange == etag {
+			start, end, rerr := parseRangeHeader(rangeHeader, fileInfo.Size)
+			if rerr != nil {
+				return nil, CodedError(http.StatusRequestedRangeNotSatisfiable, rerr.Error())
+			}
+
+			offset = start
+			limit = end - start + 1
+			resp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileInfo.Size))
+			status = http.StatusPartialContent
+		} else {
+			offset = 0
+			limit = 0
+		}
+	}
+
 	rc, err := fs.ReadAt(path, offset)
+	if err != nil {
+		return nil, err
+	}
+
 	if limit > 0 {
+		// limit may ask for more than remains in the file past offset; the
+		// Range branch above already clamps limit to the file size, but the
+		// plain offset/limit query params don't, so clamp here too rather
+		// than promising more bytes than ReadAt will actually yield.
+		if remaining := fileInfo.Size - offset; limit > remaining {
+			limit = remaining
+			if limit < 0 {
+				limit = 0
+			}
+		}
+		resp.Header().Set("Content-Length", strconv.FormatInt(limit, 10))
 		rc = &ReadCloserWrapper{
 			Reader: io.LimitReader(rc, limit),
 			Closer: rc,
 		}
+	} else if offset <= fileInfo.Size {
+		resp.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size-offset, 10))
 	}
+	resp.WriteHeader(status)
 
-	if err != nil {
+	if err := s.copyChunked(req, resp, rc, chunkSize); err != nil {
+		rc.Close()
 		return nil, err
 	}
-
-	io.Copy(resp, rc)
 	return nil, rc.Close()
 }
 
+// parseRangeHeader parses a single-range "bytes=start-end" Range header value
+// against a file of the given size, returning the inclusive start/end byte
+// offsets to serve. Multiple ranges are not supported. Suffix ranges
+// ("bytes=-500") and open-ended ranges ("bytes=500-") are both handled.
+func parseRangeHeader(rangeHeader string, size int64) (start, end int64, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		return 0, 0, fmt.Errorf("unsupported Range unit in %q", rangeHeader)
+	}
+
+	spec := strings.TrimPrefix(rangeHeader, prefix)
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("multiple ranges not supported")
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed Range header %q", rangeHeader)
+	}
+
+	switch {
+	case parts[0] == "" && parts[1] == "":
+		return 0, 0, fmt.Errorf("malformed Range header %q", rangeHeader)
+	case parts[0] == "":
+		// Suffix range: the last N bytes of the file.
+		n, perr := strconv.ParseInt(parts[1], 10, 64)
+		if perr != nil {
+			return 0, 0, fmt.Errorf("malformed Range header %q", rangeHeader)
+		}
+		if n > size {
+			n = size
+		}
+		start = size - n
+		end = size - 1
+	case parts[1] == "":
+		if start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("malformed Range header %q", rangeHeader)
+		}
+		end = size - 1
+	default:
+		if start, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("malformed Range header %q", rangeHeader)
+		}
+		if end, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("malformed Range header %q", rangeHeader)
+		}
+	}
+
+	if start < 0 || start > end || start >= size {
+		return 0, 0, fmt.Errorf("range start %d out of bounds for file of size %d", start, size)
+	}
+	if end >= size {
+		end = size - 1
+	}
+
+	return start, end, nil
+}
+
+// parseChunkSize parses the chunk_size query parameter, defaulting to
+// streamFrameSize and clamping to [minChunkSize, maxChunkSize] so operators streaming over slow
+// links can tune latency vs syscall overhead without being able to force
+// pathological buffering.
+func parseChunkSize(q url.Values) (int64, error) {
+	chunkSize := int64(streamFrameSize)
+	if chunkSizeStr := q.Get("chunk_size"); chunkSizeStr != "" {
+		var err error
+		if chunkSize, err = strconv.ParseInt(chunkSizeStr, 10, 64); err != nil {
+			return 0, fmt.Errorf("error parsing chunk_size: %v", err)
+		}
+	}
+
+	switch {
+	case chunkSize < minChunkSize:
+		chunkSize = minChunkSize
+	case chunkSize > maxChunkSize:
+		chunkSize = maxChunkSize
+	}
+
+	return chunkSize, nil
+}
+
+// copyChunked reads rc in fixed-size chunks through an io.LimitReader and
+// writes each chunk to resp, flushing immediately rather than buffering at
+// whatever size io.Copy picks. It checks req.Context() between chunks so a
+// client disconnect stops the read as soon as the in-flight chunk completes
+// instead of running until the reader is exhausted.
+func (s *HTTPServer) copyChunked(req *http.Request, resp http.ResponseWriter, rc io.Reader, chunkSize int64) error {
+	output := ioutils.NewWriteFlusher(resp)
+	ctx := req.Context()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		n, err := io.Copy(output, io.LimitReader(rc, chunkSize))
+		if err != nil {
+			return err
+		}
+		if n < chunkSize {
+			// Short read means rc is exhausted.
+			return nil
+		}
+	}
+}
+
 // ReadCloserWrapper wraps a LimitReader so that a file is closed once it has been
 // read
 type ReadCloserWrapper struct {
@@ -212,6 +357,12 @@ func (s *HTTPServer) FileCatRequest(resp http.ResponseWriter, req *http.Request)
 	if path = q.Get("path"); path == "" {
 		return nil, fileNameNotPresentErr
 	}
+
+	chunkSize, err := parseChunkSize(q)
+	if err != nil {
+		return nil, err
+	}
+
 	fs, err := s.agent.client.GetAllocFS(allocID)
 	if err != nil {
 		return nil, err
@@ -229,20 +380,25 @@ func (s *HTTPServer) FileCatRequest(resp http.ResponseWriter, req *http.Request)
 	if err != nil {
 		return nil, err
 	}
-	io.Copy(resp, r)
+
+	if err := s.copyChunked(req, resp, r, chunkSize); err != nil {
+		r.Close()
+		return nil, err
+	}
 	return nil, r.Close()
 }
 
-/*
-
-// Stream streams the content of a file blocking on EOF.
-// The parameters are:
+// Stream streams the content of a file blocking on EOF. The parameters are:
 // * path: path to file to stream.
 // * offset: The offset to start streaming data at, defaults to zero.
 // * origin: Either "start" or "end" and defines from where the offset is
 //           applied. Defaults to "start".
+// * plain: If true the raw bytes of the file are written directly to the
+//           response instead of being wrapped in framed StreamFrames,
+//           mirroring the Logs endpoint's plain toggle. Defaults to false.
 func (s *HTTPServer) Stream(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
 	var allocID, path string
+	var plain bool
 	var err error
 
 	q := req.URL.Query()
@@ -255,10 +411,15 @@ func (s *HTTPServer) Stream(resp http.ResponseWriter, req *http.Request) (interf
 		return nil, fileNameNotPresentErr
 	}
 
+	if plainStr := q.Get("plain"); plainStr != "" {
+		if plain, err = strconv.ParseBool(plainStr); err != nil {
+			return nil, fmt.Errorf("Failed to parse plain field to boolean: %v", err)
+		}
+	}
+
 	var offset int64
 	offsetString := q.Get("offset")
 	if offsetString != "" {
-		var err error
 		if offset, err = strconv.ParseInt(offsetString, 10, 64); err != nil {
 			return nil, fmt.Errorf("error parsing offset: %v", err)
 		}
@@ -273,175 +434,106 @@ func (s *HTTPServer) Stream(resp http.ResponseWriter, req *http.Request) (interf
 		return nil, invalidOrigin
 	}
 
-	fs, err := s.agent.client.GetAllocFS(allocID)
+	// Stream must be able to push each frame to the peer as soon as it is
+	// produced, which requires a ResponseWriter that supports incremental
+	// flushing under both HTTP/1.1 and HTTP/2.
+	if _, ok := resp.(http.Flusher); !ok {
+		return nil, fmt.Errorf("streaming not supported by underlying ResponseWriter")
+	}
+
+	// Create an output that gets flushed on every write, compressing it if
+	// the peer negotiated gzip/zstd.
+	compression := streamCompression(req, q.Get("compression"))
+	output, err := newCompressedOutput(resp, compression)
 	if err != nil {
 		return nil, err
 	}
+	defer output.Close()
 
-	fileInfo, err := fs.Stat(path)
+	handler, err := s.agent.Server().StreamingRpcHandler("FileSystem.Stream")
 	if err != nil {
 		return nil, err
 	}
-	if fileInfo.IsDir {
-		return nil, fmt.Errorf("file %q is a directory", path)
-	}
-
-	// If offsetting from the end subtract from the size
-	if origin == "end" {
-		offset = fileInfo.Size - offset
 
+	fsReq := &cstructs.FsStreamRequest{
+		AllocID:   allocID,
+		Path:      path,
+		Offset:    offset,
+		Origin:    origin,
+		PlainText: plain,
 	}
+	s.parseToken(req, &fsReq.QueryOptions.AuthToken)
 
-	// Create an output that gets flushed on every write
-	output := ioutils.NewWriteFlusher(resp)
-
-	// Create the framer
-	framer := sframer.NewStreamFramer(output, false, streamHeartbeatRate, streamBatchWindow, streamFrameSize)
-	framer.Run()
-	defer framer.Destroy()
-
-	err = s.stream(offset, path, fs, framer, nil)
-	if err != nil && err != syscall.EPIPE {
-		return nil, err
+	if rpcErr := streamingRPCBridge(req.Context(), handler, "FileSystem.Stream", fsReq, output); rpcErr != nil {
+		return nil, rpcErr
 	}
-
 	return nil, nil
 }
 
-// parseFramerErr takes an error and returns an error. The error will
-// potentially change if it was caused by the connection being closed.
-func parseFramerErr(err error) error {
-	if err == nil {
-		return nil
-	}
-
-	errMsg := err.Error()
-
-	if strings.Contains(errMsg, io.ErrClosedPipe.Error()) {
-		// The pipe check is for tests
-		return syscall.EPIPE
-	}
-
-	// The connection was closed by our peer
-	if strings.Contains(errMsg, syscall.EPIPE.Error()) || strings.Contains(errMsg, syscall.ECONNRESET.Error()) {
-		return syscall.EPIPE
-	}
-
-	// Windows version of ECONNRESET
-	//XXX(schmichael) I could find no existing error or constant to
-	//                compare this against.
-	if strings.Contains(errMsg, "forcibly closed") {
-		return syscall.EPIPE
-	}
+// flushWriteCloser is the subset of behavior Logs and Stream need from their
+// output sink: a writer that can be explicitly flushed down to the peer and
+// closed to finalize the stream.
+type flushWriteCloser interface {
+	io.Writer
+	Flush() error
+	io.Closer
+}
 
-	return err
+// writeFlusher adapts ioutils.WriteFlusher, whose Flush method has no return
+// value, to the flushWriteCloser interface so the uncompressed path can share
+// the same code as the gzip/zstd paths.
+type writeFlusher struct {
+	*ioutils.WriteFlusher
 }
 
-// stream is the internal method to stream the content of a file. eofCancelCh is
-// used to cancel the stream if triggered while at EOF. If the connection is
-// broken an EPIPE error is returned
-func (s *HTTPServer) stream(offset int64, path string,
-	fs allocdir.AllocDirFS, framer *sframer.StreamFramer,
-	eofCancelCh chan error) error {
+func (w writeFlusher) Flush() error {
+	w.WriteFlusher.Flush()
+	return nil
+}
 
-	// Get the reader
-	f, err := fs.ReadAt(path, offset)
-	if err != nil {
-		return err
+// streamCompression negotiates which compression scheme, if any, to apply to
+// a streaming response. The explicit override (the compression query
+// parameter) takes precedence over Accept-Encoding so that clients which
+// cannot set request headers can still opt in.
+func streamCompression(req *http.Request, override string) string {
+	switch override {
+	case "gzip", "zstd", "none":
+		return override
 	}
-	defer f.Close()
-
-	// Create a tomb to cancel watch events
-	t := tomb.Tomb{}
-	defer func() {
-		t.Kill(nil)
-		t.Done()
-	}()
-
-	// Create a variable to allow setting the last event
-	var lastEvent string
-
-	// Only create the file change watcher once. But we need to do it after we
-	// read and reach EOF.
-	var changes *watch.FileChanges
-
-	// Start streaming the data
-	data := make([]byte, streamFrameSize)
-OUTER:
-	for {
-		// Read up to the max frame size
-		n, readErr := f.Read(data)
-
-		// Update the offset
-		offset += int64(n)
-
-		// Return non-EOF errors
-		if readErr != nil && readErr != io.EOF {
-			return readErr
-		}
 
-		// Send the frame
-		if n != 0 || lastEvent != "" {
-			if err := framer.Send(path, lastEvent, data[:n], offset); err != nil {
-				return parseFramerErr(err)
-			}
-		}
-
-		// Clear the last event
-		if lastEvent != "" {
-			lastEvent = ""
-		}
-
-		// Just keep reading
-		if readErr == nil {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(enc), ";", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[1]) == "q=0" {
 			continue
 		}
-
-		// If EOF is hit, wait for a change to the file
-		if changes == nil {
-			changes, err = fs.ChangeEvents(path, offset, &t)
-			if err != nil {
-				return err
-			}
+		switch strings.TrimSpace(parts[0]) {
+		case "zstd":
+			return "zstd"
+		case "gzip":
+			return "gzip"
 		}
+	}
+	return "none"
+}
 
-		for {
-			select {
-			case <-changes.Modified:
-				continue OUTER
-			case <-changes.Deleted:
-				return parseFramerErr(framer.Send(path, deleteEvent, nil, offset))
-			case <-changes.Truncated:
-				// Close the current reader
-				if err := f.Close(); err != nil {
-					return err
-				}
-
-				// Get a new reader at offset zero
-				offset = 0
-				var err error
-				f, err = fs.ReadAt(path, offset)
-				if err != nil {
-					return err
-				}
-				defer f.Close()
-
-				// Store the last event
-				lastEvent = truncateEvent
-				continue OUTER
-			case <-framer.ExitCh():
-				return parseFramerErr(framer.Err())
-			case err, ok := <-eofCancelCh:
-				if !ok {
-					return nil
-				}
-
-				return err
-			}
-		}
+// newCompressedOutput wraps resp in a flushWriteCloser that writes the
+// negotiated compression scheme, setting Content-Encoding and Vary on resp.
+// Headers must be set before the first byte is written to resp.
+func newCompressedOutput(resp http.ResponseWriter, compression string) (flushWriteCloser, error) {
+	resp.Header().Set("Vary", "Accept-Encoding")
+
+	base := writeFlusher{ioutils.NewWriteFlusher(resp)}
+	switch compression {
+	case "gzip":
+		resp.Header().Set("Content-Encoding", "gzip")
+		return gzip.NewWriter(base), nil
+	case "zstd":
+		resp.Header().Set("Content-Encoding", "zstd")
+		return zstd.NewWriter(base)
+	default:
+		return base, nil
 	}
 }
-*/
 
 // Logs streams the content of a log blocking on EOF. The parameters are:
 // * task: task name to stream logs for.
@@ -501,17 +593,20 @@ func (s *HTTPServer) Logs(resp http.ResponseWriter, req *http.Request) (interfac
 		return nil, invalidOrigin
 	}
 
-	// Create an output that gets flushed on every write
-	output := ioutils.NewWriteFlusher(resp)
+	// Create an output that gets flushed on every write, compressing it if
+	// the peer negotiated gzip/zstd.
+	compression := streamCompression(req, q.Get("compression"))
+	output, err := newCompressedOutput(resp, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
 
-	// TODO make work for both
-	// Get the client's handler
 	handler, err := s.agent.Server().StreamingRpcHandler("FileSystem.Logs")
 	if err != nil {
 		return nil, err
 	}
 
-	// Create the request arguments
 	fsReq := &cstructs.FsLogsRequest{
 		AllocID:   allocID,
 		Task:      task,
@@ -523,72 +618,8 @@ func (s *HTTPServer) Logs(resp http.ResponseWriter, req *http.Request) (interfac
 	}
 	s.parseToken(req, &fsReq.QueryOptions.AuthToken)
 
-	p1, p2 := net.Pipe()
-	decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
-	encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
-
-	// Create a goroutine that closes the pipe if the connection closes.
-	ctx, cancel := context.WithCancel(req.Context())
-	go func() {
-		<-ctx.Done()
-		p1.Close()
-		s.logger.Printf("--------- HTTP:  Request finished. Closing pipes")
-	}()
-
-	// Create a channel that decodes the results
-	errCh := make(chan HTTPCodedError)
-	go func() {
-		// Send the request
-		if err := encoder.Encode(fsReq); err != nil {
-			errCh <- CodedError(500, err.Error())
-			cancel()
-			return
-		}
-
-		for {
-			select {
-			case <-ctx.Done():
-				errCh <- nil
-				cancel()
-				s.logger.Printf("--------- HTTP:  Exitting frame copier")
-				return
-			default:
-			}
-
-			var res cstructs.StreamErrWrapper
-			if err := decoder.Decode(&res); err != nil {
-				//errCh <- CodedError(500, err.Error())
-				errCh <- CodedError(501, err.Error())
-				cancel()
-				return
-			}
-			s.logger.Printf("--------- HTTP:  Decoded stream wrapper")
-
-			if err := res.Error; err != nil {
-				if err.Code != nil {
-					errCh <- CodedError(int(*err.Code), err.Error())
-					cancel()
-					return
-				}
-			}
-
-			s.logger.Printf("--------- HTTP:  Copying payload of size: %d", len(res.Payload))
-			if n, err := io.Copy(output, bytes.NewBuffer(res.Payload)); err != nil {
-				//errCh <- CodedError(500, err.Error())
-				errCh <- CodedError(502, err.Error())
-				cancel()
-				return
-			} else {
-				s.logger.Printf("--------- HTTP:  Copied payload: %d bytes", n)
-			}
-		}
-	}()
-
-	handler(p2)
-	cancel()
-	codedErr := <-errCh
-	if codedErr != nil && (codedErr == io.EOF || strings.Contains(codedErr.Error(), "closed")) {
-		codedErr = nil
+	if rpcErr := streamingRPCBridge(req.Context(), handler, "FileSystem.Logs", fsReq, output); rpcErr != nil {
+		return nil, rpcErr
 	}
-	return nil, codedErr
+	return nil, nil
 }
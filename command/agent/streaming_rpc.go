@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/ugorji/go/codec"
+)
+
+// streamingRPCBridge drives a server-side streaming RPC to completion over an
+// HTTP response. It replaces the net.Pipe/codec/cancel-goroutine plumbing
+// that Logs used to hand-roll: handler is the func(net.Conn)
+// returned by Server.StreamingRpcHandler for rpcName, rpcReq is encoded as
+// the RPC's single request frame, and every cstructs.StreamErrWrapper the RPC
+// decodes is copied into output and flushed immediately afterward, including
+// empty-payload heartbeats, so followers make progress instead of waiting on
+// a buffer to fill.
+//
+// ctx governs the whole bridge: cancelling it (the HTTP client disconnecting)
+// tears the RPC pipe down exactly once. A clean peer close (io.EOF or the
+// pipe being closed) is not treated as an error; a real decode/transport
+// failure, or an error surfaced by the RPC itself via
+// StreamErrWrapper.Error.Code, comes back as a typed HTTPCodedError instead
+// of the magic 501/502 placeholders this used to return.
+func streamingRPCBridge(ctx context.Context, handler func(net.Conn), rpcName string, rpcReq interface{}, output flushWriteCloser) HTTPCodedError {
+	p1, p2 := net.Pipe()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Tear the pipe down as soon as either side is done so the decode loop
+	// below doesn't block forever on a peer that's gone.
+	go func() {
+		<-ctx.Done()
+		p1.Close()
+	}()
+
+	errCh := make(chan HTTPCodedError, 1)
+	go func() {
+		encoder := codec.NewEncoder(p1, structs.MsgpackHandle)
+		if err := encoder.Encode(rpcReq); err != nil {
+			if !isClosedStreamErr(err) {
+				errCh <- CodedError(500, fmt.Sprintf("error encoding %s request: %v", rpcName, err))
+			} else {
+				errCh <- nil
+			}
+			cancel()
+			return
+		}
+
+		decoder := codec.NewDecoder(p1, structs.MsgpackHandle)
+		for {
+			select {
+			case <-ctx.Done():
+				errCh <- nil
+				return
+			default:
+			}
+
+			var res cstructs.StreamErrWrapper
+			if err := decoder.Decode(&res); err != nil {
+				if isClosedStreamErr(err) {
+					errCh <- nil
+				} else {
+					errCh <- CodedError(500, fmt.Sprintf("error decoding %s response: %v", rpcName, err))
+				}
+				cancel()
+				return
+			}
+
+			if rpcErr := res.Error; rpcErr != nil {
+				code := 500
+				if rpcErr.Code != nil {
+					code = int(*rpcErr.Code)
+				}
+				errCh <- CodedError(code, rpcErr.Error())
+				cancel()
+				return
+			}
+
+			if _, err := io.Copy(output, bytes.NewReader(res.Payload)); err != nil {
+				errCh <- CodedError(500, err.Error())
+				cancel()
+				return
+			}
+
+			// Flush after every frame, including empty heartbeats, so the
+			// client's decoder makes progress instead of waiting for a
+			// compressor's internal window to fill.
+			if err := output.Flush(); err != nil {
+				errCh <- CodedError(500, err.Error())
+				cancel()
+				return
+			}
+		}
+	}()
+
+	handler(p2)
+	cancel()
+	return <-errCh
+}
+
+// isClosedStreamErr reports whether err indicates the streaming RPC pipe was
+// torn down as part of a normal shutdown (the HTTP client disconnected, or
+// the RPC finished) rather than a real decode/transport failure.
+func isClosedStreamErr(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
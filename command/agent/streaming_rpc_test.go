@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	cstructs "github.com/hashicorp/nomad/client/structs"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/ugorji/go/codec"
+)
+
+// fakeOutput is an in-memory flushWriteCloser so the bridge can be tested
+// without a real HTTP response writer.
+type fakeOutput struct {
+	bytes.Buffer
+	flushes int
+	closed  bool
+}
+
+func (f *fakeOutput) Flush() error {
+	f.flushes++
+	return nil
+}
+
+func (f *fakeOutput) Close() error {
+	f.closed = true
+	return nil
+}
+
+// fakeStreamingHandler returns a func(net.Conn) that discards the single
+// request frame streamingRPCBridge encodes, then encodes frames back in
+// order, mimicking a server-side streaming RPC handler.
+func fakeStreamingHandler(frames []cstructs.StreamErrWrapper) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+
+		decoder := codec.NewDecoder(conn, structs.MsgpackHandle)
+		var discard interface{}
+		if err := decoder.Decode(&discard); err != nil {
+			return
+		}
+
+		encoder := codec.NewEncoder(conn, structs.MsgpackHandle)
+		for _, frame := range frames {
+			frame := frame
+			if err := encoder.Encode(&frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestStreamingRPCBridge_CopiesFramesAndFlushesEveryOne(t *testing.T) {
+	frames := []cstructs.StreamErrWrapper{
+		{Payload: []byte("hello ")},
+		{Payload: []byte("world")},
+		{Payload: nil}, // heartbeat
+	}
+
+	out := &fakeOutput{}
+	if err := streamingRPCBridge(context.Background(), fakeStreamingHandler(frames), "Test.Stream", struct{}{}, out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got, want := out.String(), "hello world"; got != want {
+		t.Fatalf("got payload %q, want %q", got, want)
+	}
+	if out.flushes != len(frames) {
+		t.Fatalf("got %d flushes, want %d", out.flushes, len(frames))
+	}
+}
+
+func TestStreamingRPCBridge_SurfacesRPCError(t *testing.T) {
+	code := int64(400)
+	frames := []cstructs.StreamErrWrapper{
+		{Error: &cstructs.RpcError{Message: "bad request", Code: &code}},
+	}
+
+	out := &fakeOutput{}
+	err := streamingRPCBridge(context.Background(), fakeStreamingHandler(frames), "Test.Stream", struct{}{}, out)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if err.Code() != 400 {
+		t.Fatalf("got code %d, want 400", err.Code())
+	}
+}
+
+func TestStreamingRPCBridge_CleanCloseIsNotAnError(t *testing.T) {
+	out := &fakeOutput{}
+	closeImmediately := func(conn net.Conn) {
+		conn.Close()
+	}
+
+	if err := streamingRPCBridge(context.Background(), closeImmediately, "Test.Stream", struct{}{}, out); err != nil {
+		t.Fatalf("expected a clean peer close to not be an error, got: %v", err)
+	}
+}
+
+func TestStreamingRPCBridge_ContextCancelTearsDownPipeOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	out := &fakeOutput{}
+	blocked := make(chan struct{})
+	handler := func(conn net.Conn) {
+		defer conn.Close()
+		<-blocked
+	}
+
+	done := make(chan HTTPCodedError, 1)
+	go func() {
+		done <- streamingRPCBridge(ctx, handler, "Test.Stream", struct{}{}, out)
+	}()
+
+	cancel()
+	close(blocked)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected cancellation to be treated as a clean close, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("streamingRPCBridge did not return after context cancellation")
+	}
+}